@@ -0,0 +1,51 @@
+// Package common holds AWS helpers shared by the post-processor that are
+// generic enough to not belong in the plugin package itself.
+package common
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/hashicorp/go-multierror"
+)
+
+// DestroyAMIs describes imageIds, deregisters each one, and deletes every
+// EBS snapshot attached to it. A failure on one image does not stop the
+// rest from being torn down; all errors are aggregated and returned
+// together.
+func DestroyAMIs(imageIds []*string, ec2conn ec2iface.EC2API) error {
+	if len(imageIds) == 0 {
+		return nil
+	}
+
+	output, err := ec2conn.DescribeImages(&ec2.DescribeImagesInput{
+		ImageIds: imageIds,
+	})
+	if err != nil {
+		return err
+	}
+
+	var result *multierror.Error
+	for _, image := range output.Images {
+		if _, err := ec2conn.DeregisterImage(&ec2.DeregisterImageInput{
+			ImageId: image.ImageId,
+		}); err != nil {
+			result = multierror.Append(result, fmt.Errorf("deregistering %s: %s", *image.ImageId, err))
+			continue
+		}
+
+		for _, device := range image.BlockDeviceMappings {
+			if device.Ebs == nil {
+				continue
+			}
+			if _, err := ec2conn.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+				SnapshotId: device.Ebs.SnapshotId,
+			}); err != nil {
+				result = multierror.Append(result, fmt.Errorf("deleting snapshot %s for %s: %s", *device.Ebs.SnapshotId, *image.ImageId, err))
+			}
+		}
+	}
+
+	return result.ErrorOrNil()
+}
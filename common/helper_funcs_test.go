@@ -0,0 +1,126 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// fakeEC2 implements just enough of ec2iface.EC2API for DestroyAMIs; every
+// other method panics if called, via the embedded nil interface.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	images            map[string]*ec2.Image
+	deregisterErr     map[string]error
+	deleteSnapshotErr map[string]error
+
+	deregistered     []string
+	deletedSnapshots []string
+}
+
+func (f *fakeEC2) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	var images []*ec2.Image
+	for _, id := range input.ImageIds {
+		if image, ok := f.images[*id]; ok {
+			images = append(images, image)
+		}
+	}
+	return &ec2.DescribeImagesOutput{Images: images}, nil
+}
+
+func (f *fakeEC2) DeregisterImage(input *ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error) {
+	if err, ok := f.deregisterErr[*input.ImageId]; ok {
+		return nil, err
+	}
+	f.deregistered = append(f.deregistered, *input.ImageId)
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	if err, ok := f.deleteSnapshotErr[*input.SnapshotId]; ok {
+		return nil, err
+	}
+	f.deletedSnapshots = append(f.deletedSnapshots, *input.SnapshotId)
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func imageWithSnapshot(imageID, snapshotID string) *ec2.Image {
+	return &ec2.Image{
+		ImageId: aws.String(imageID),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			{Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID)}},
+		},
+	}
+}
+
+func TestDestroyAMIs(t *testing.T) {
+	fake := &fakeEC2{
+		images: map[string]*ec2.Image{
+			"ami-1": imageWithSnapshot("ami-1", "snap-1"),
+			"ami-2": imageWithSnapshot("ami-2", "snap-2"),
+		},
+	}
+
+	err := DestroyAMIs([]*string{aws.String("ami-1"), aws.String("ami-2")}, fake)
+	if err != nil {
+		t.Fatalf("DestroyAMIs returned error: %s", err)
+	}
+	if len(fake.deregistered) != 2 {
+		t.Errorf("expected 2 images deregistered, got %d (%v)", len(fake.deregistered), fake.deregistered)
+	}
+	if len(fake.deletedSnapshots) != 2 {
+		t.Errorf("expected 2 snapshots deleted, got %d (%v)", len(fake.deletedSnapshots), fake.deletedSnapshots)
+	}
+}
+
+func TestDestroyAMIs_ContinuesPastDeregisterError(t *testing.T) {
+	fake := &fakeEC2{
+		images: map[string]*ec2.Image{
+			"ami-1": imageWithSnapshot("ami-1", "snap-1"),
+			"ami-2": imageWithSnapshot("ami-2", "snap-2"),
+		},
+		deregisterErr: map[string]error{"ami-1": errors.New("boom")},
+	}
+
+	err := DestroyAMIs([]*string{aws.String("ami-1"), aws.String("ami-2")}, fake)
+	if err == nil {
+		t.Fatal("expected an aggregated error")
+	}
+	if len(fake.deregistered) != 1 || fake.deregistered[0] != "ami-2" {
+		t.Fatalf("expected ami-2 to still be deregistered despite ami-1 failing, got %v", fake.deregistered)
+	}
+	if len(fake.deletedSnapshots) != 1 || fake.deletedSnapshots[0] != "snap-2" {
+		t.Fatalf("expected snap-2 to still be deleted, got %v", fake.deletedSnapshots)
+	}
+}
+
+func TestDestroyAMIs_ContinuesPastSnapshotError(t *testing.T) {
+	fake := &fakeEC2{
+		images: map[string]*ec2.Image{
+			"ami-1": imageWithSnapshot("ami-1", "snap-1"),
+		},
+		deleteSnapshotErr: map[string]error{"snap-1": errors.New("still in use")},
+	}
+
+	err := DestroyAMIs([]*string{aws.String("ami-1")}, fake)
+	if err == nil {
+		t.Fatal("expected an error for the failed snapshot delete")
+	}
+	if len(fake.deregistered) != 1 {
+		t.Fatalf("expected the AMI to still be deregistered, got %v", fake.deregistered)
+	}
+}
+
+func TestDestroyAMIs_EmptyInput(t *testing.T) {
+	fake := &fakeEC2{}
+	if err := DestroyAMIs(nil, fake); err != nil {
+		t.Fatalf("expected no error for empty imageIds, got %s", err)
+	}
+	if len(fake.deregistered) != 0 {
+		t.Fatalf("expected no calls for empty imageIds, got %v", fake.deregistered)
+	}
+}
@@ -1,37 +1,150 @@
 package amazonamimanagement
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/hashicorp/go-multierror"
 	awscommon "github.com/mitchellh/packer/builder/amazon/common"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
+
+	amicommon "github.com/thecrux4020/packer-post-processor-amazon-ami-management/common"
 )
 
+// maxConcurrentRegions bounds how many regions are cleaned up at once so a
+// large Regions list doesn't open an unbounded number of EC2 connections.
+const maxConcurrentRegions = 4
+
+// snapshotDeleteRetries/snapshotDeleteRetryDelay bound how long
+// force_delete_snapshot waits out InvalidSnapshot.InUse while the
+// snapshot's AMI finishes deregistering.
+const snapshotDeleteRetries = 5
+const snapshotDeleteRetryDelay = 5 * time.Second
+
+// syncUi serializes Message calls across the concurrent per-region
+// goroutines in PostProcess. packer.Ui implementations aren't guaranteed
+// to be safe for concurrent use, so every region writes through this
+// wrapper instead of the raw Ui it was handed.
+type syncUi struct {
+	packer.Ui
+	mu sync.Mutex
+}
+
+func (u *syncUi) Message(message string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Ui.Message(message)
+}
+
 type Config struct {
 	common.PackerConfig    `mapstructure:",squash"`
 	awscommon.AccessConfig `mapstructure:",squash"`
 
-	Identifier   string `mapstructure:"identifier"`
-	KeepReleases int    `mapstructure:"keep_releases"`
-	AccessKey    string `mapstructure:"access_key"`
-	SecretKey    string `mapstructure:"secret_key"`
-	Region       string `mapstructure:"region"`
+	Identifier      string            `mapstructure:"identifier"`
+	KeepReleases    int               `mapstructure:"keep_releases"`
+	RetentionPolicy []RetentionWindow `mapstructure:"retention_policy"`
+	AccessKey       string            `mapstructure:"access_key"`
+	SecretKey       string            `mapstructure:"secret_key"`
+	Region          string            `mapstructure:"region"`
+	Regions         []string          `mapstructure:"regions"`
+
+	ForceDeregister     bool `mapstructure:"force_deregister"`
+	ForceDeleteSnapshot bool `mapstructure:"force_delete_snapshot"`
+
+	DryRun     bool   `mapstructure:"dry_run"`
+	PlanOutput string `mapstructure:"plan_output"`
+
+	KeepTags     map[string]string `mapstructure:"keep_tags"`
+	ExtraFilters []Filter          `mapstructure:"extra_filters"`
 
 	ctx interpolate.Context
 }
 
+// Filter is a user-specified Name/Values pair appended to the
+// DescribeImages call, e.g. {name: "tag:in_use_by", values: ["prod"]}.
+type Filter struct {
+	Name   string   `mapstructure:"name"`
+	Values []string `mapstructure:"values"`
+}
+
+// PlanEntry is one AMI a dry_run pass would delete, along with the
+// snapshots that would go with it.
+type PlanEntry struct {
+	Region       string            `json:"region"`
+	ImageID      string            `json:"image_id"`
+	CreationDate string            `json:"creation_date"`
+	Tags         map[string]string `json:"tags"`
+	SnapshotIDs  []string          `json:"snapshot_ids"`
+}
+
+// RetentionWindow describes a single grandfather-father-son retention
+// bucket: starting `start` ago and ending `stop` ago, keep the oldest AMI
+// out of every `interval`-sized bucket of creation dates that falls in the
+// window, and mark the rest for deletion. Start/Stop/Interval accept a Go
+// duration string (e.g. "168h") or an integer with a d/w/mo/y suffix
+// (e.g. "7d", "4w", "12mo") since users think of retention in calendar
+// units, not hours; mo/y are calendar approximations (30/365 days).
+type RetentionWindow struct {
+	Start    string `mapstructure:"start"`
+	Stop     string `mapstructure:"stop"`
+	Interval string `mapstructure:"interval"`
+}
+
+// retentionDurationPattern matches an integer followed by a day/week/
+// month/year suffix, e.g. "7d", "4w", "12mo", "1y".
+var retentionDurationPattern = regexp.MustCompile(`^(\d+)(d|w|mo|y)$`)
+
+// parseRetentionDuration parses a retention_policy bound. It first tries
+// time.ParseDuration (so "168h", "30m" etc. keep working), then falls back
+// to the calendar-unit suffixes documented on RetentionWindow.
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+
+	match := retentionDurationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("invalid duration %q: expected a Go duration (e.g. \"168h\") or an integer with a d/w/mo/y suffix (e.g. \"7d\")", s)
+	}
+
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %s", s, err)
+	}
+
+	var unit time.Duration
+	switch match[2] {
+	case "d":
+		unit = 24 * time.Hour
+	case "w":
+		unit = 7 * 24 * time.Hour
+	case "mo":
+		unit = 30 * 24 * time.Hour
+	case "y":
+		unit = 365 * 24 * time.Hour
+	}
+	return time.Duration(n) * unit, nil
+}
+
 type PostProcessor struct {
 	ec2conn ec2iface.EC2API
 	config  Config
@@ -50,102 +163,479 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 		return err
 	}
 
-	return nil
+	return p.validateConfig()
+}
+
+// validateConfig rejects a malformed retention_policy or extra_filters at
+// Configure time, so a typo surfaces before any destructive PostProcess
+// run starts rather than mid-run as a per-region error.
+func (p *PostProcessor) validateConfig() error {
+	var errs *multierror.Error
+
+	for i, window := range p.config.RetentionPolicy {
+		if _, err := parseRetentionDuration(window.Start); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("retention_policy[%d].start: %s", i, err))
+		}
+		if _, err := parseRetentionDuration(window.Stop); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("retention_policy[%d].stop: %s", i, err))
+		}
+		if _, err := parseRetentionDuration(window.Interval); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("retention_policy[%d].interval: %s", i, err))
+		}
+	}
+
+	for i, filter := range p.config.ExtraFilters {
+		if filter.Name == "" {
+			errs = multierror.Append(errs, fmt.Errorf("extra_filters[%d]: name is required", i))
+		}
+		if len(filter.Values) == 0 {
+			errs = multierror.Append(errs, fmt.Errorf("extra_filters[%d]: values is required", i))
+		}
+	}
+
+	return errs.ErrorOrNil()
 }
 
 func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
 	log.Println("Running Amazon AMI Management post-processor")
 
-	ec2conn := p.ec2conn
-	if ec2conn == nil {
-		// If no ec2conn is set, then we use the real connection
-		config := aws.NewConfig().WithRegion(p.config.Region).WithMaxRetries(11)
-		sess := session.New(config)
-		creds := credentials.NewChainCredentials([]credentials.Provider{
-			&credentials.StaticProvider{Value: credentials.Value{
-				AccessKeyID:     p.config.AccessKey,
-				SecretAccessKey: p.config.SecretKey,
-			}},
-			&credentials.EnvProvider{},
-			&credentials.SharedCredentialsProvider{Filename: "", Profile: ""},
-			&ec2rolecreds.EC2RoleProvider{
-				Client: ec2metadata.New(sess),
-			},
-		})
+	regions := p.regionsToClean(artifact)
+	safeUi := &syncUi{Ui: ui}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentRegions)
+	var mu sync.Mutex
+	var result *multierror.Error
+	var plan []PlanEntry
+
+	for _, region := range regions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(region string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			regionPlan, err := p.cleanupRegion(safeUi, region)
 
-		log.Println("Creating AWS session")
-		ec2Session := session.New(config.WithCredentials(creds))
-		ec2conn = ec2.New(ec2Session)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result = multierror.Append(result, fmt.Errorf("%s: %s", region, err))
+			}
+			plan = append(plan, regionPlan...)
+		}(region)
 	}
+	wg.Wait()
 
-	log.Println("Describing images for generation management")
-	output, err := ec2conn.DescribeImages(&ec2.DescribeImagesInput{
-		Filters: []*ec2.Filter{
-			{
-				Name: aws.String("tag:Amazon_AMI_Management_Identifier"),
-				Values: []*string{
-					aws.String(p.config.Identifier),
-				},
-			},
+	if p.config.DryRun && p.config.PlanOutput != "" {
+		if err := writePlan(p.config.PlanOutput, plan); err != nil {
+			result = multierror.Append(result, fmt.Errorf("writing plan_output: %s", err))
+		}
+	}
+
+	return artifact, true, result.ErrorOrNil()
+}
+
+// writePlan marshals the dry_run deletion plan to JSON and writes it to
+// path.
+func writePlan(path string, plan []PlanEntry) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// regionsToClean returns the set of regions to run cleanup in: any region
+// explicitly configured via Regions, plus (when the incoming artifact is an
+// awscommon.Artifact) every region its AMIs were copied to. Falls back to
+// the single configured Region when neither source yields anything.
+func (p *PostProcessor) regionsToClean(artifact packer.Artifact) []string {
+	set := make(map[string]bool)
+	for _, region := range p.config.Regions {
+		set[region] = true
+	}
+	if amiArtifact, ok := artifact.(*awscommon.Artifact); ok {
+		for region := range amiArtifact.Amis {
+			set[region] = true
+		}
+	}
+	if len(set) == 0 {
+		set[p.config.Region] = true
+	}
+
+	regions := make([]string, 0, len(set))
+	for region := range set {
+		regions = append(regions, region)
+	}
+	return regions
+}
+
+// ec2Conn returns the EC2 API connection to use for region. When the
+// PostProcessor was constructed with an explicit ec2conn (tests), that
+// connection is reused as-is; otherwise a fresh per-region session is
+// built from the configured credentials.
+func (p *PostProcessor) ec2Conn(region string) ec2iface.EC2API {
+	if p.ec2conn != nil {
+		return p.ec2conn
+	}
+
+	config := aws.NewConfig().WithRegion(region).WithMaxRetries(11)
+	sess := session.New(config)
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     p.config.AccessKey,
+			SecretAccessKey: p.config.SecretKey,
+		}},
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{Filename: "", Profile: ""},
+		&ec2rolecreds.EC2RoleProvider{
+			Client: ec2metadata.New(sess),
 		},
 	})
+
+	log.Printf("Creating AWS session for %s", region)
+	ec2Session := session.New(config.WithCredentials(creds))
+	return ec2.New(ec2Session)
+}
+
+// cleanupRegion runs the full describe/retain/delete cycle against a
+// single region's EC2 connection. In dry_run mode no AMI or snapshot is
+// touched; the plan of what would have been deleted is returned instead.
+func (p *PostProcessor) cleanupRegion(ui packer.Ui, region string) ([]PlanEntry, error) {
+	ec2conn := p.ec2Conn(region)
+
+	log.Printf("Describing images for generation management in %s", region)
+	images, err := p.describeImages(ec2conn)
 	if err != nil {
-		return nil, true, err
+		return nil, err
 	}
 
 	// AMIs are sorted in descending order by creation date
-	sort(
-		len(output.Images),
-		func(i, j int) bool {
-			iTime, _ := time.Parse("2006-01-02T15:04:05.000Z", *output.Images[i].CreationDate)
-			jTime, _ := time.Parse("2006-01-02T15:04:05.000Z", *output.Images[j].CreationDate)
-			return iTime.After(jTime)
-		},
-		func(i, j int) {
-			output.Images[i], output.Images[j] = output.Images[j], output.Images[i]
-		},
-	)
+	sort.Slice(images, func(i, j int) bool {
+		iTime, _ := time.Parse("2006-01-02T15:04:05.000Z", *images[i].CreationDate)
+		jTime, _ := time.Parse("2006-01-02T15:04:05.000Z", *images[j].CreationDate)
+		return iTime.After(jTime)
+	})
 
-	log.Println("Deleting old images...")
-	for i, image := range output.Images {
-		if i < p.config.KeepReleases {
+	// keep_tags runs ahead of the retention policy so a protected AMI never
+	// consumes a retention_policy bucket or a keep_releases slot.
+	protected, rest := p.partitionByKeepTags(images)
+
+	survivors, err := p.applyRetentionPolicy(rest)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool, len(survivors)+len(protected))
+	for _, image := range survivors {
+		keep[*image.ImageId] = true
+	}
+	for _, image := range protected {
+		keep[*image.ImageId] = true
+	}
+
+	var condemned []*ec2.Image
+	for _, image := range images {
+		if keep[*image.ImageId] {
 			continue
 		}
-		ui.Message(fmt.Sprintf("Deleting image: %s", *image.ImageId))
+		condemned = append(condemned, image)
+	}
+	if len(condemned) == 0 {
+		return nil, nil
+	}
+
+	if p.config.DryRun {
+		plan := make([]PlanEntry, len(condemned))
+		for i, image := range condemned {
+			plan[i] = newPlanEntry(image, region)
+		}
+		logPlan(ui, plan)
+		return plan, nil
+	}
+
+	for _, image := range condemned {
+		ui.Message(fmt.Sprintf("Deleting image: %s (%s)", *image.ImageId, region))
+	}
+
+	log.Printf("Deleting old images in %s...", region)
+	if p.config.ForceDeleteSnapshot {
+		// The shared helper always hard-fails a snapshot on its first
+		// DeleteSnapshot error; force_delete_snapshot needs to retry a
+		// snapshot still attached to a deregistering AMI, so that path
+		// tears down condemned images itself.
+		return nil, p.destroyAMIsWithSnapshotRetry(ec2conn, condemned)
+	}
+
+	imageIds := make([]*string, len(condemned))
+	for i, image := range condemned {
+		imageIds[i] = image.ImageId
+	}
+	return nil, amicommon.DestroyAMIs(imageIds, ec2conn)
+}
+
+// newPlanEntry captures the parts of image a dry_run plan needs to report.
+func newPlanEntry(image *ec2.Image, region string) PlanEntry {
+	tags := make(map[string]string, len(image.Tags))
+	for _, tag := range image.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+
+	var snapshotIDs []string
+	for _, device := range image.BlockDeviceMappings {
+		if device.Ebs != nil {
+			snapshotIDs = append(snapshotIDs, *device.Ebs.SnapshotId)
+		}
+	}
+
+	return PlanEntry{
+		Region:       region,
+		ImageID:      *image.ImageId,
+		CreationDate: *image.CreationDate,
+		Tags:         tags,
+		SnapshotIDs:  snapshotIDs,
+	}
+}
+
+// logPlan renders the dry_run plan as a human-readable table via ui.Message.
+func logPlan(ui packer.Ui, plan []PlanEntry) {
+	for _, entry := range plan {
+		ui.Message(fmt.Sprintf(
+			"[dry-run] %s\tregion=%s\tcreated=%s\tsnapshots=%s",
+			entry.ImageID, entry.Region, entry.CreationDate, strings.Join(entry.SnapshotIDs, ","),
+		))
+	}
+}
+
+// destroyAMIsWithSnapshotRetry mirrors common.DestroyAMIs but routes
+// snapshot deletion through deleteSnapshot so force_delete_snapshot's
+// InvalidSnapshot.InUse retry can kick in.
+func (p *PostProcessor) destroyAMIsWithSnapshotRetry(ec2conn ec2iface.EC2API, images []*ec2.Image) error {
+	var result *multierror.Error
+	for _, image := range images {
 		log.Printf("Deleting image AMI (%s)", *image.ImageId)
 		if _, err := ec2conn.DeregisterImage(&ec2.DeregisterImageInput{
 			ImageId: image.ImageId,
 		}); err != nil {
-			return nil, true, err
+			result = multierror.Append(result, fmt.Errorf("deregistering %s: %s", *image.ImageId, err))
+			continue
 		}
 
 		// DeregisterImage method only perform to AMI
 		// Because it retain snapshots. Following operation is deleting snapshots.
-		log.Printf("Deleting snapshot related to AMI (%s)", *image.ImageId)
+		// Every snapshot is attempted even if an earlier one fails, so a
+		// single stuck snapshot never leaves the rest dangling.
 		for _, device := range image.BlockDeviceMappings {
 			// skip delete if use ephemeral devise
 			if device.Ebs == nil {
 				continue
 			}
 			log.Printf("Deleting snapshot (%s) related to AMI (%s)", *device.Ebs.SnapshotId, *image.ImageId)
-			if _, err := ec2conn.DeleteSnapshot(&ec2.DeleteSnapshotInput{
-				SnapshotId: device.Ebs.SnapshotId,
-			}); err != nil {
-				return nil, true, err
+			if err := p.deleteSnapshot(ec2conn, device.Ebs.SnapshotId); err != nil {
+				result = multierror.Append(result, fmt.Errorf("deleting snapshot %s for %s: %s", *device.Ebs.SnapshotId, *image.ImageId, err))
 			}
 		}
 	}
+	return result.ErrorOrNil()
+}
+
+// describeImages finds the AMIs managed by this post-processor. By default
+// that's everything carrying the Amazon_AMI_Management_Identifier tag; with
+// force_deregister set, AMIs whose name matches Identifier are included too,
+// so images that predate tagging still get cleaned up.
+func (p *PostProcessor) describeImages(ec2conn ec2iface.EC2API) ([]*ec2.Image, error) {
+	images := make(map[string]*ec2.Image)
+
+	tagOutput, err := ec2conn.DescribeImages(&ec2.DescribeImagesInput{
+		Filters: append([]*ec2.Filter{
+			{
+				Name: aws.String("tag:Amazon_AMI_Management_Identifier"),
+				Values: []*string{
+					aws.String(p.config.Identifier),
+				},
+			},
+		}, p.extraFilters()...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range tagOutput.Images {
+		images[*image.ImageId] = image
+	}
+
+	if p.config.ForceDeregister {
+		nameOutput, err := ec2conn.DescribeImages(&ec2.DescribeImagesInput{
+			Filters: append([]*ec2.Filter{
+				{
+					Name: aws.String("name"),
+					Values: []*string{
+						aws.String(p.config.Identifier),
+					},
+				},
+			}, p.extraFilters()...),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range nameOutput.Images {
+			images[*image.ImageId] = image
+		}
+	}
+
+	result := make([]*ec2.Image, 0, len(images))
+	for _, image := range images {
+		result = append(result, image)
+	}
+	return result, nil
+}
+
+// extraFilters converts the configured extra_filters into EC2 filters
+// appended to the identifier filter.
+func (p *PostProcessor) extraFilters() []*ec2.Filter {
+	filters := make([]*ec2.Filter, len(p.config.ExtraFilters))
+	for i, f := range p.config.ExtraFilters {
+		filters[i] = &ec2.Filter{
+			Name:   aws.String(f.Name),
+			Values: aws.StringSlice(f.Values),
+		}
+	}
+	return filters
+}
+
+// deleteSnapshot deletes a single EBS snapshot. With force_delete_snapshot
+// set, an InvalidSnapshot.InUse error (the snapshot's AMI hasn't finished
+// deregistering yet) is retried with a short delay instead of failing
+// immediately.
+func (p *PostProcessor) deleteSnapshot(ec2conn ec2iface.EC2API, snapshotID *string) error {
+	_, err := ec2conn.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: snapshotID})
+	if err == nil || !p.config.ForceDeleteSnapshot {
+		return err
+	}
+
+	for attempt := 0; attempt < snapshotDeleteRetries && isSnapshotInUse(err); attempt++ {
+		time.Sleep(snapshotDeleteRetryDelay)
+		_, err = ec2conn.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: snapshotID})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func isSnapshotInUse(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "InvalidSnapshot.InUse"
+}
 
-	return artifact, true, nil
+// partitionByKeepTags splits images (already sorted newest first) into
+// those carrying a keep_tags match, which are always preserved, and the
+// rest, which are still subject to retention_policy/keep_releases.
+func (p *PostProcessor) partitionByKeepTags(images []*ec2.Image) (protected, rest []*ec2.Image) {
+	for _, image := range images {
+		if p.isKeptByTag(image) {
+			protected = append(protected, image)
+		} else {
+			rest = append(rest, image)
+		}
+	}
+	return protected, rest
 }
 
-func sort(len int, lessFunc func(i, j int) bool, swapFunc func(i, j int)) error {
-	for n := 0; n < len-1; n++ {
-		for m := len - 1; m > n; m-- {
-			if !lessFunc(m-1, m) {
-				swapFunc(m-1, m)
+// isKeptByTag reports whether image carries any tag matching the
+// configured keep_tags map.
+func (p *PostProcessor) isKeptByTag(image *ec2.Image) bool {
+	for _, tag := range image.Tags {
+		if want, ok := p.config.KeepTags[*tag.Key]; ok && want == *tag.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRetentionPolicy decides which of images (already sorted newest
+// first) survive. When no retention_policy windows are configured it
+// falls back to the flat keep_releases cap. Otherwise every window is
+// walked bucket by bucket, the oldest AMI in each populated bucket is
+// kept, and any AMI the windows never touched falls back to
+// keep_releases so it isn't deleted or kept by surprise.
+func (p *PostProcessor) applyRetentionPolicy(images []*ec2.Image) ([]*ec2.Image, error) {
+	if len(p.config.RetentionPolicy) == 0 {
+		return p.applyKeepReleases(images), nil
+	}
+
+	covered := make(map[string]bool)
+	keep := make(map[string]bool)
+	now := time.Now()
+
+	for _, window := range p.config.RetentionPolicy {
+		// Already validated in Configure; errors here would mean the
+		// config changed out from under a running PostProcess.
+		start, err := parseRetentionDuration(window.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention_policy start %q: %s", window.Start, err)
+		}
+		stop, err := parseRetentionDuration(window.Stop)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention_policy stop %q: %s", window.Stop, err)
+		}
+		interval, err := parseRetentionDuration(window.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention_policy interval %q: %s", window.Interval, err)
+		}
+
+		windowStart := now.Add(-start)
+		windowStop := now.Add(-stop)
+		for cursor := windowStart; cursor.Before(windowStop); cursor = cursor.Add(interval) {
+			bucketEnd := cursor.Add(interval)
+
+			var oldest *ec2.Image
+			var oldestCreated time.Time
+			for _, image := range images {
+				created, err := time.Parse("2006-01-02T15:04:05.000Z", *image.CreationDate)
+				if err != nil {
+					continue
+				}
+				if created.Before(cursor) || !created.Before(bucketEnd) {
+					continue
+				}
+
+				covered[*image.ImageId] = true
+				if oldest == nil || created.Before(oldestCreated) {
+					oldest = image
+					oldestCreated = created
+				}
 			}
+
+			if oldest != nil {
+				keep[*oldest.ImageId] = true
+			}
+		}
+	}
+
+	var survivors []*ec2.Image
+	var uncovered []*ec2.Image
+	for _, image := range images {
+		if keep[*image.ImageId] {
+			survivors = append(survivors, image)
+			continue
+		}
+		if !covered[*image.ImageId] {
+			uncovered = append(uncovered, image)
+		}
+	}
+
+	survivors = append(survivors, p.applyKeepReleases(uncovered)...)
+	return survivors, nil
+}
+
+// applyKeepReleases keeps the first KeepReleases images out of a list
+// already sorted newest first.
+func (p *PostProcessor) applyKeepReleases(images []*ec2.Image) []*ec2.Image {
+	var survivors []*ec2.Image
+	for i, image := range images {
+		if i < p.config.KeepReleases {
+			survivors = append(survivors, image)
 		}
 	}
-	return nil
+	return survivors
 }
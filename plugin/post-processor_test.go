@@ -0,0 +1,118 @@
+package amazonamimanagement
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func imageAt(id string, created time.Time) *ec2.Image {
+	return &ec2.Image{
+		ImageId:      aws.String(id),
+		CreationDate: aws.String(created.UTC().Format("2006-01-02T15:04:05.000Z")),
+	}
+}
+
+func TestApplyRetentionPolicy_FallsBackToKeepReleases(t *testing.T) {
+	now := time.Now()
+	images := []*ec2.Image{
+		imageAt("ami-1", now.Add(-1*time.Hour)),
+		imageAt("ami-2", now.Add(-2*time.Hour)),
+		imageAt("ami-3", now.Add(-3*time.Hour)),
+	}
+
+	p := &PostProcessor{config: Config{KeepReleases: 2}}
+	survivors, err := p.applyRetentionPolicy(images)
+	if err != nil {
+		t.Fatalf("applyRetentionPolicy returned error: %s", err)
+	}
+	if len(survivors) != 2 {
+		t.Fatalf("expected 2 survivors, got %d", len(survivors))
+	}
+}
+
+func TestApplyRetentionPolicy_KeepsOldestPerBucket(t *testing.T) {
+	now := time.Now()
+	images := []*ec2.Image{
+		imageAt("ami-newest", now.Add(-1*time.Hour)),
+		imageAt("ami-oldest-today", now.Add(-20*time.Hour)),
+		imageAt("ami-yesterday", now.Add(-30*time.Hour)),
+	}
+
+	p := &PostProcessor{
+		config: Config{
+			RetentionPolicy: []RetentionWindow{
+				{Start: "2d", Stop: "0h", Interval: "24h"},
+			},
+		},
+	}
+
+	survivors, err := p.applyRetentionPolicy(images)
+	if err != nil {
+		t.Fatalf("applyRetentionPolicy returned error: %s", err)
+	}
+
+	keep := make(map[string]bool, len(survivors))
+	for _, image := range survivors {
+		keep[*image.ImageId] = true
+	}
+
+	if !keep["ami-oldest-today"] {
+		t.Errorf("expected ami-oldest-today to survive as the oldest image in its bucket")
+	}
+	if !keep["ami-yesterday"] {
+		t.Errorf("expected ami-yesterday to survive as the only image in its bucket")
+	}
+	if keep["ami-newest"] {
+		t.Errorf("ami-newest shares a bucket with an older image and should not survive")
+	}
+}
+
+func TestApplyRetentionPolicy_RejectsInvalidDuration(t *testing.T) {
+	p := &PostProcessor{
+		config: Config{
+			RetentionPolicy: []RetentionWindow{
+				{Start: "not-a-duration", Stop: "0h", Interval: "24h"},
+			},
+		},
+	}
+
+	if _, err := p.applyRetentionPolicy([]*ec2.Image{}); err == nil {
+		t.Fatal("expected an error for an invalid retention_policy duration")
+	}
+}
+
+func TestPartitionByKeepTags(t *testing.T) {
+	p := &PostProcessor{
+		config: Config{
+			KeepTags: map[string]string{"released": "true"},
+		},
+	}
+
+	protectedImage := &ec2.Image{
+		ImageId: aws.String("ami-protected"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("released"), Value: aws.String("true")},
+		},
+	}
+	mismatchedTagImage := &ec2.Image{
+		ImageId: aws.String("ami-mismatched"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("released"), Value: aws.String("false")},
+		},
+	}
+	plainImage := &ec2.Image{
+		ImageId: aws.String("ami-plain"),
+	}
+
+	protected, rest := p.partitionByKeepTags([]*ec2.Image{protectedImage, mismatchedTagImage, plainImage})
+
+	if len(protected) != 1 || *protected[0].ImageId != "ami-protected" {
+		t.Fatalf("expected only ami-protected to be protected, got %v", protected)
+	}
+	if len(rest) != 2 {
+		t.Fatalf("expected 2 images left unprotected, got %d", len(rest))
+	}
+}